@@ -1,7 +1,6 @@
 package configuration
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,23 +9,64 @@ import (
 	"github.com/KyberNetwork/reserve-data/common"
 	"github.com/KyberNetwork/reserve-data/common/blockchain"
 	"github.com/KyberNetwork/reserve-data/common/blockchain/nonce"
+	"github.com/KyberNetwork/reserve-data/common/logger"
 	"github.com/KyberNetwork/reserve-data/data/fetcher"
 	"github.com/KyberNetwork/reserve-data/exchange"
 	"github.com/KyberNetwork/reserve-data/exchange/binance"
 	"github.com/KyberNetwork/reserve-data/exchange/bittrex"
 	"github.com/KyberNetwork/reserve-data/exchange/huobi"
+	"github.com/KyberNetwork/reserve-data/exchange/remote"
 	"github.com/KyberNetwork/reserve-data/settings"
+	"github.com/KyberNetwork/reserve-data/storage/postgres"
 )
 
+// workerURLPrefix marks a KYBER_EXCHANGES entry as pointing at a remote
+// cmd/exchange-worker process rather than an in-process exchange, e.g.
+// "huobi=worker://10.0.0.5:9001".
+const workerURLPrefix = "worker://"
+
+// parseWorkerExchange splits a "<name>=worker://host:port" KYBER_EXCHANGES
+// entry into the exchange name and worker address. ok is false for any
+// entry that isn't in that form, so callers fall back to constructing the
+// exchange in-process as before.
+func parseWorkerExchange(exparam string) (name, addr string, ok bool) {
+	parts := strings.SplitN(exparam, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], workerURLPrefix) {
+		return "", "", false
+	}
+	return parts[0], strings.TrimPrefix(parts[1], workerURLPrefix), true
+}
+
+// tradeHistoryDBURL returns the Postgres connection string to use for the
+// shared trade-history store, or "" to fall back to a local BoltDB file.
+// It mirrors the env-driven selection already used for KYBER_EXCHANGES; a
+// future settingPaths.tradeHistoryDBURL can replace this once the setting
+// is threaded through SettingPaths.
+func tradeHistoryDBURL() string {
+	return os.Getenv("TRADE_HISTORY_DB_URL")
+}
+
+// newTradeHistoryStorage builds the common.TradeHistoryStorage for an
+// exchange: a shared Postgres store when TRADE_HISTORY_DB_URL is set, or a
+// per-exchange BoltDB file at boltPath otherwise. All three exchanges go
+// through this single constructor so they can never end up on mismatched
+// backends the way binance used to (it mistakenly reused huobi.NewBoltStorage).
+func newTradeHistoryStorage(boltPath string, log *logger.Logger) (common.TradeHistoryStorage, error) {
+	if dbURL := tradeHistoryDBURL(); dbURL != "" {
+		return postgres.NewTradeHistoryStorage(dbURL, log)
+	}
+	return huobi.NewBoltStorage(boltPath, log)
+}
+
 type ExchangePool struct {
 	Exchanges map[common.ExchangeID]interface{}
 }
 
-func AsyncUpdateDepositAddress(ex common.Exchange, tokenID, addr string, wait *sync.WaitGroup, setting *settings.Settings) {
+func AsyncUpdateDepositAddress(ex common.Exchange, tokenID, addr string, wait *sync.WaitGroup, setting *settings.Settings, log *logger.Logger) {
 	defer wait.Done()
 	token, err := setting.GetInternalTokenByID(tokenID)
 	if err != nil {
-		log.Panicf("ERROR: Can't get internal token %s. Error: %s", tokenID, err)
+		log.Panicf("Can't get internal token %s. Error: %s", tokenID, err)
 	}
 	ex.UpdateDepositAddress(token, addr)
 }
@@ -55,16 +95,34 @@ func getHuobiInterface(kyberENV string) huobi.Interface {
 	return envInterface
 }
 
+// NewExchangePool builds the pool of exchanges listed in KYBER_EXCHANGES.
+// log is used for every diagnostic the pool and its exchanges' storages
+// emit. A misconfigured exchange makes it return an error instead of
+// panicking; no pool is returned then, so the other KYBER_EXCHANGES entries
+// are not available either. An unknown token in an exchange's deposit
+// address config still panics, in AsyncUpdateDepositAddress.
 func NewExchangePool(
 	addressConfig common.AddressConfig,
 	settingPaths SettingPaths,
 	blockchain *blockchain.BaseBlockchain,
 	minDeposit common.ExchangesMinDepositConfig,
-	kyberENV string, setting *settings.Settings) (*ExchangePool, error) {
+	kyberENV string, setting *settings.Settings, log *logger.Logger) (*ExchangePool, error) {
 	exchanges := map[common.ExchangeID]interface{}{}
 	params := os.Getenv("KYBER_EXCHANGES")
 	exparams := strings.Split(params, ",")
 	for _, exparam := range exparams {
+		if name, workerAddr, ok := parseWorkerExchange(exparam); ok {
+			// Dial the worker instead of constructing the exchange
+			// in-process: FetcherExchanges() gets a fetcher.Exchange that
+			// forwards every fetch/trade call over RPC.
+			remoteLog := log.WithExchange(name)
+			remoteEx, err := remote.Dial(common.ExchangeID(name), workerAddr, remoteLog)
+			if err != nil {
+				return nil, err
+			}
+			exchanges[remoteEx.ID()] = remoteEx
+			continue
+		}
 		switch exparam {
 		case "stable_exchange":
 			stableEx, err := exchange.NewStableEx(
@@ -77,11 +135,12 @@ func NewExchangePool(
 			}
 			exchanges[stableEx.ID()] = stableEx
 		case "bittrex":
+			bittrexLog := log.WithExchange("bittrex")
 			bittrexSigner := bittrex.NewSignerFromFile(settingPaths.secretPath)
 			endpoint := bittrex.NewBittrexEndpoint(bittrexSigner, getBittrexInterface(kyberENV))
-			bittrexStorage, err := bittrex.NewBoltStorage(filepath.Join(common.CmdDirLocation(), "bittrex.db"))
+			bittrexStorage, err := newTradeHistoryStorage(filepath.Join(common.CmdDirLocation(), "bittrex.db"), bittrexLog)
 			if err != nil {
-				log.Panic(err)
+				return nil, err
 			}
 			bit, err := exchange.NewBittrex(
 				addressConfig.Exchanges["bittrex"],
@@ -95,17 +154,18 @@ func NewExchangePool(
 			wait := sync.WaitGroup{}
 			for tokenID, addr := range addressConfig.Exchanges["bittrex"] {
 				wait.Add(1)
-				go AsyncUpdateDepositAddress(bit, tokenID, addr, &wait, setting)
+				go AsyncUpdateDepositAddress(bit, tokenID, addr, &wait, setting, bittrexLog)
 			}
 			wait.Wait()
 			bit.UpdatePairsPrecision()
 			exchanges[bit.ID()] = bit
 		case "binance":
+			binanceLog := log.WithExchange("binance")
 			binanceSigner := binance.NewSignerFromFile(settingPaths.secretPath)
 			endpoint := binance.NewBinanceEndpoint(binanceSigner, getBinanceInterface(kyberENV))
-			storage, err := huobi.NewBoltStorage(filepath.Join(common.CmdDirLocation(), "binance.db"))
+			storage, err := newTradeHistoryStorage(filepath.Join(common.CmdDirLocation(), "binance.db"), binanceLog)
 			if err != nil {
-				log.Panic(err)
+				return nil, err
 			}
 			bin, err := exchange.NewBinance(
 				addressConfig.Exchanges["binance"],
@@ -119,46 +179,72 @@ func NewExchangePool(
 			wait := sync.WaitGroup{}
 			for tokenID, addr := range addressConfig.Exchanges["binance"] {
 				wait.Add(1)
-				go AsyncUpdateDepositAddress(bin, tokenID, addr, &wait, setting)
+				go AsyncUpdateDepositAddress(bin, tokenID, addr, &wait, setting, binanceLog)
 			}
 			wait.Wait()
 			bin.UpdatePairsPrecision()
 			exchanges[bin.ID()] = bin
 		case "huobi":
-			huobiSigner := huobi.NewSignerFromFile(settingPaths.secretPath)
-			endpoint := huobi.NewHuobiEndpoint(huobiSigner, getHuobiInterface(kyberENV))
-			storage, err := huobi.NewBoltStorage(filepath.Join(common.CmdDirLocation(), "huobi.db"))
-			intermediatorSigner := HuobiIntermediatorSignerFromFile(settingPaths.secretPath)
-			intermediatorNonce := nonce.NewTimeWindow(intermediatorSigner.GetAddress(), 10000)
+			huobiLog := log.WithExchange("huobi")
+			storage, err := newTradeHistoryStorage(filepath.Join(common.CmdDirLocation(), "huobi.db"), huobiLog)
 			if err != nil {
-				log.Panic(err)
+				return nil, err
 			}
-			huobi, err := exchange.NewHuobi(
-				addressConfig.Exchanges["huobi"],
-				endpoint,
-				blockchain,
-				intermediatorSigner,
-				intermediatorNonce,
-				storage,
-				minDeposit.Exchanges["huobi"],
-				setting,
-			)
+			huobiEx, err := NewHuobiExchange(addressConfig, settingPaths.secretPath, blockchain, minDeposit, kyberENV, setting, storage, huobiLog)
 			if err != nil {
 				return nil, err
 			}
-			wait := sync.WaitGroup{}
-			for tokenID, addr := range addressConfig.Exchanges["huobi"] {
-				wait.Add(1)
-				go AsyncUpdateDepositAddress(huobi, tokenID, addr, &wait, setting)
-			}
-			wait.Wait()
-			huobi.UpdatePairsPrecision()
-			exchanges[huobi.ID()] = huobi
+			exchanges[huobiEx.ID()] = huobiEx
 		}
 	}
 	return &ExchangePool{exchanges}, nil
 }
 
+// NewHuobiExchange builds a fully wired huobi exchange: signer, endpoint,
+// the intermediator signer/nonce huobi's deposit flow needs, and the async
+// per-token deposit address population NewExchangePool's "huobi" case used
+// to do inline. It's factored out here, rather than left inline, so
+// cmd/exchange-worker can host the exact same huobi instance standalone
+// instead of duplicating this wiring. It takes secretPath directly (rather
+// than a SettingPaths) so a caller outside this package, which can't reach
+// SettingPaths's unexported fields, can still use it.
+func NewHuobiExchange(
+	addressConfig common.AddressConfig,
+	secretPath string,
+	blockchain *blockchain.BaseBlockchain,
+	minDeposit common.ExchangesMinDepositConfig,
+	kyberENV string,
+	setting *settings.Settings,
+	storage common.TradeHistoryStorage,
+	log *logger.Logger,
+) (common.Exchange, error) {
+	huobiSigner := huobi.NewSignerFromFile(secretPath)
+	endpoint := huobi.NewHuobiEndpoint(huobiSigner, getHuobiInterface(kyberENV))
+	intermediatorSigner := HuobiIntermediatorSignerFromFile(secretPath)
+	intermediatorNonce := nonce.NewTimeWindow(intermediatorSigner.GetAddress(), 10000)
+	huobiEx, err := exchange.NewHuobi(
+		addressConfig.Exchanges["huobi"],
+		endpoint,
+		blockchain,
+		intermediatorSigner,
+		intermediatorNonce,
+		storage,
+		minDeposit.Exchanges["huobi"],
+		setting,
+	)
+	if err != nil {
+		return nil, err
+	}
+	wait := sync.WaitGroup{}
+	for tokenID, addr := range addressConfig.Exchanges["huobi"] {
+		wait.Add(1)
+		go AsyncUpdateDepositAddress(huobiEx, tokenID, addr, &wait, setting, log)
+	}
+	wait.Wait()
+	huobiEx.UpdatePairsPrecision()
+	return huobiEx, nil
+}
+
 func (self *ExchangePool) FetcherExchanges() []fetcher.Exchange {
 	result := []fetcher.Exchange{}
 	for _, ex := range self.Exchanges {
@@ -167,10 +253,18 @@ func (self *ExchangePool) FetcherExchanges() []fetcher.Exchange {
 	return result
 }
 
+// CoreExchanges returns every pool entry that implements the full
+// common.Exchange surface (deposit/order management, not just fetching).
+// A worker:// entry only dials exchange/remote.Exchange, which implements
+// fetcher.Exchange for price/trade-history fetching but not common.Exchange,
+// so it's silently excluded here rather than panicking on the type
+// assertion the way an unconditional one would.
 func (self *ExchangePool) CoreExchanges() []common.Exchange {
 	result := []common.Exchange{}
 	for _, ex := range self.Exchanges {
-		result = append(result, ex.(common.Exchange))
+		if coreEx, ok := ex.(common.Exchange); ok {
+			result = append(result, coreEx)
+		}
 	}
 	return result
 }
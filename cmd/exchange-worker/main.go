@@ -0,0 +1,222 @@
+// Command exchange-worker hosts one exchange's fetch/trade operations over
+// RPC (see exchange/remote), so that exchange can run in its own process
+// instead of inside the core reserve-data binary: a stuck REST call or a
+// locked BoltDB file on this exchange no longer blocks anything else.
+// Point cmd/configuration.NewExchangePool at it with a
+// "<exchange>=worker://host:port" entry in KYBER_EXCHANGES.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+
+	"github.com/KyberNetwork/reserve-data/cmd/configuration"
+	"github.com/KyberNetwork/reserve-data/common"
+	"github.com/KyberNetwork/reserve-data/common/logger"
+	"github.com/KyberNetwork/reserve-data/exchange/huobi"
+	"github.com/KyberNetwork/reserve-data/exchange/remote"
+)
+
+// localExchange is the subset of the real exchange structs
+// (exchange.NewHuobi/NewBinance/NewBittrex) this worker forwards RPC calls
+// into; it mirrors exchange/remote.Exchange's method set.
+type localExchange interface {
+	FetchOnePairData(timepoint uint64, pair common.TokenPairID) ([]byte, error)
+	FetchTradeHistory(timepoint uint64) (common.AllTradeHistory, error)
+	DepositStatus(id common.ActivityID, txHash, currency string, amount float64, timepoint uint64) (string, error)
+	WithdrawStatus(id, currency string, amount float64, timepoint uint64) (string, string, error)
+	OrderStatus(id common.ActivityID, base, quote string, timepoint uint64) (string, error)
+	Trade(tradeType string, base, quote string, rate, amount float64, timepoint uint64) (common.ActivityID, float64, float64, bool, error)
+	Withdraw(token, amount, address string, timepoint uint64) (string, error)
+	CancelOrder(id common.ActivityID) error
+}
+
+// Worker is the net/rpc service exchange/remote.Exchange dials into. Each
+// method unwraps the RPC args, calls the matching localExchange method and
+// always returns a nil Go error: a failed exchange call is reported in the
+// reply's Err field so it isn't confused with an RPC transport failure.
+type Worker struct {
+	ex  localExchange
+	log *logger.Logger
+}
+
+func errStr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (self *Worker) FetchOnePairData(args *remote.FetchOnePairDataArgs, reply *remote.FetchOnePairDataReply) error {
+	data, err := self.ex.FetchOnePairData(args.Timepoint, args.Pair)
+	reply.Data = data
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) FetchTradeHistory(args *remote.FetchTradeHistoryArgs, reply *remote.FetchTradeHistoryReply) error {
+	data, err := self.ex.FetchTradeHistory(args.Timepoint)
+	reply.Data = data
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) DepositStatus(args *remote.DepositStatusArgs, reply *remote.DepositStatusReply) error {
+	status, err := self.ex.DepositStatus(args.ID, args.TxHash, args.Currency, args.Amount, args.Timepoint)
+	reply.Status = status
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) WithdrawStatus(args *remote.WithdrawStatusArgs, reply *remote.WithdrawStatusReply) error {
+	status, txHash, err := self.ex.WithdrawStatus(args.ID, args.Currency, args.Amount, args.Timepoint)
+	reply.Status = status
+	reply.TxHash = txHash
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) OrderStatus(args *remote.OrderStatusArgs, reply *remote.OrderStatusReply) error {
+	status, err := self.ex.OrderStatus(args.ID, args.Base, args.Quote, args.Timepoint)
+	reply.Status = status
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) Trade(args *remote.TradeArgs, reply *remote.TradeReply) error {
+	id, done, remaining, finished, err := self.ex.Trade(args.TradeType, args.Base, args.Quote, args.Rate, args.Amount, args.Timepoint)
+	reply.ID = id
+	reply.Done = done
+	reply.Remaining = remaining
+	reply.Finished = finished
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) Withdraw(args *remote.WithdrawArgs, reply *remote.WithdrawReply) error {
+	txHash, err := self.ex.Withdraw(args.Token, args.Amount, args.Address, args.Timepoint)
+	reply.TxHash = txHash
+	reply.Err = errStr(err)
+	return nil
+}
+
+func (self *Worker) CancelOrder(args *remote.CancelOrderArgs, reply *remote.CancelOrderReply) error {
+	reply.Err = errStr(self.ex.CancelOrder(args.ID))
+	return nil
+}
+
+// loadAddressConfig reads path (a JSON-encoded common.AddressConfig, the
+// same format cmd/configuration's bootstrap loads) if path is non-empty, and
+// returns the zero value otherwise. The zero value is fine for a worker that
+// only fetches prices/trade history: UpdateDepositAddress is never called
+// unless addressConfig.Exchanges["<name>"] has entries.
+func loadAddressConfig(path string) (common.AddressConfig, error) {
+	cfg := common.AddressConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, json.Unmarshal(data, &cfg)
+}
+
+// loadMinDepositConfig is loadAddressConfig's counterpart for
+// common.ExchangesMinDepositConfig.
+func loadMinDepositConfig(path string) (common.ExchangesMinDepositConfig, error) {
+	cfg := common.ExchangesMinDepositConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, json.Unmarshal(data, &cfg)
+}
+
+// newLocalExchange builds the localExchange this worker hosts, reusing
+// cmd/configuration.NewHuobiExchange rather than duplicating its wiring.
+// blockchain and *settings.Settings are passed as nil: neither has a
+// constructor anywhere outside the main reserve-data process's own
+// bootstrap, so a standalone worker has no way to build them. That's fine
+// for FetchOnePairData/FetchTradeHistory, the RPC calls the fetcher
+// actually makes against a worker. DepositStatus/WithdrawStatus/OrderStatus/
+// Trade/Withdraw are forwarded as well, but run against that nil blockchain
+// and nil settings, so any of them that needs either one fails.
+func newLocalExchange(name, secretPath string, addressConfig common.AddressConfig, minDeposit common.ExchangesMinDepositConfig, storage *huobi.BoltStorage, log *logger.Logger) (localExchange, error) {
+	switch name {
+	case "huobi":
+		huobiEx, err := configuration.NewHuobiExchange(addressConfig, secretPath, nil, minDeposit, "", nil, storage, log)
+		if err != nil {
+			return nil, err
+		}
+		ex, ok := huobiEx.(localExchange)
+		if !ok {
+			return nil, fmt.Errorf("exchange-worker: huobi exchange does not implement the RPC-forwarded method set")
+		}
+		return ex, nil
+	default:
+		return nil, fmt.Errorf("exchange-worker: %s is not a supported -exchange yet (only huobi is wired so far)", name)
+	}
+}
+
+func main() {
+	exchangeName := flag.String("exchange", "huobi", "which exchange to host (only huobi is supported)")
+	addr := flag.String("addr", ":9000", "address to listen on")
+	secretPath := flag.String("secret", "", "path to the exchange API secret file, as used by huobi.NewSignerFromFile")
+	boltPath := flag.String("bolt", "", "path to this exchange's BoltDB file")
+	addrConfigPath := flag.String("addr-config", "", "path to a JSON common.AddressConfig file; only needed if this worker manages deposit addresses")
+	minDepositConfigPath := flag.String("min-deposit-config", "", "path to a JSON common.ExchangesMinDepositConfig file; only needed if this worker manages deposit addresses")
+	flag.Parse()
+
+	log := logger.New().WithExchange(*exchangeName)
+
+	if *secretPath == "" {
+		log.Panicf("-secret is required")
+	}
+	if *boltPath == "" {
+		*boltPath = filepath.Join(".", *exchangeName+".db")
+	}
+	storage, err := huobi.NewBoltStorage(*boltPath, log)
+	if err != nil {
+		log.Panicf("cannot open storage: %s", err.Error())
+	}
+
+	addressConfig, err := loadAddressConfig(*addrConfigPath)
+	if err != nil {
+		log.Panicf("cannot load -addr-config: %s", err.Error())
+	}
+	minDeposit, err := loadMinDepositConfig(*minDepositConfigPath)
+	if err != nil {
+		log.Panicf("cannot load -min-deposit-config: %s", err.Error())
+	}
+
+	ex, err := newLocalExchange(*exchangeName, *secretPath, addressConfig, minDeposit, storage, log)
+	if err != nil {
+		log.Panicf("%s", err.Error())
+	}
+
+	worker := &Worker{ex: ex, log: log}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Worker", worker); err != nil {
+		log.Panicf("cannot register worker: %s", err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Panicf("cannot listen on %s: %s", *addr, err.Error())
+	}
+	log.Infof("exchange worker for %s listening on %s", *exchangeName, *addr)
+	if err := http.Serve(listener, mux); err != nil {
+		log.Panicf("worker server stopped: %s", err.Error())
+	}
+}
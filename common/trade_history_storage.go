@@ -0,0 +1,23 @@
+package common
+
+// TradeHistoryStorage is the persistence interface every exchange uses to
+// keep its trade history and huobi-style intermediator transactions. It is
+// implemented by exchange/huobi.BoltStorage (one BoltDB file per process)
+// and by the Postgres-backed storage, which lets several reserve-data
+// instances share a single database and removes the file-locking
+// restriction that comes with BoltDB.
+type TradeHistoryStorage interface {
+	StoreTradeHistory(data AllTradeHistory) error
+	GetTradeHistory(fromTime, toTime uint64) (AllTradeHistory, error)
+	// GetTradeHistoryPage returns up to limit trades in [fromTime, toTime],
+	// in increasing timestamp order, and a cursor to pass back in to resume
+	// after the last one returned. It is the bounded alternative to
+	// GetTradeHistory for ranges too wide to load into memory at once.
+	GetTradeHistoryPage(fromTime, toTime uint64, cursor []byte, limit int) (AllTradeHistory, []byte, error)
+	GetLastIDTradeHistory(exchange, pair string) (string, error)
+
+	StorePendingIntermediateTx(id ActivityID, data TXEntry) error
+	GetPendingIntermediateTXs() (map[ActivityID]TXEntry, error)
+	StoreIntermediateTx(id ActivityID, data TXEntry) error
+	GetIntermedatorTx(id ActivityID) (TXEntry, error)
+}
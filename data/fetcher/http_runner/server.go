@@ -1,14 +1,24 @@
 package http_runner
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
 	"math"
 
 	"github.com/KyberNetwork/reserve-data/common"
+	"github.com/KyberNetwork/reserve-data/common/logger"
 	raven "github.com/getsentry/raven-go"
 	"github.com/gin-contrib/sentry"
 	"github.com/gin-gonic/gin"
@@ -18,35 +28,51 @@ import (
 // timestamp parameter in request is omit or malformed.
 const MAX_TIMESPOT uint64 = math.MaxUint64
 
+// MAX_SIGNATURE_AGE is how far X-Timestamp may drift from the server's
+// clock, in either direction, before a signed request is rejected.
+const MAX_SIGNATURE_AGE = 30 * time.Second
+
+// TLSConfig carries the cert/key pair the tick endpoints serve with and,
+// optionally, a client CA bundle to turn on mTLS. Leave it nil to keep
+// serving plain HTTP.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
 // HttpRunnerServer is the HTTP ticker server.
 type HttpRunnerServer struct {
-	runner *HttpRunner
-	host   string
-	r      *gin.Engine
-	http   *http.Server
+	runner    *HttpRunner
+	host      string
+	tlsConfig *TLSConfig
+	secret    string
+	log       *logger.Logger
+	r         *gin.Engine
+	http      *http.Server
 }
 
 // getTimePoint returns the timepoint from query parameter.
 // If no timestamp parameter is supplied, or it is invalid, returns the default one.
-func getTimePoint(c *gin.Context) uint64 {
+func (self *HttpRunnerServer) getTimePoint(c *gin.Context) uint64 {
 	timestamp := c.DefaultQuery("timestamp", "")
 	if timestamp == "" {
-		log.Printf("Interpreted timestamp(%s) to default - %d\n", timestamp, MAX_TIMESPOT)
+		self.log.Infof("Interpreted timestamp(%s) to default - %d", timestamp, MAX_TIMESPOT)
 		return MAX_TIMESPOT
 	} else {
 		timepoint, err := strconv.ParseUint(timestamp, 10, 64)
 		if err != nil {
-			log.Printf("Interpreted timestamp(%s) to default - %d\n", timestamp, MAX_TIMESPOT)
+			self.log.Infof("Interpreted timestamp(%s) to default - %d", timestamp, MAX_TIMESPOT)
 			return MAX_TIMESPOT
 		} else {
-			log.Printf("Interpreted timestamp(%s) to %d\n", timestamp, timepoint)
+			self.log.Infof("Interpreted timestamp(%s) to %d", timestamp, timepoint)
 			return timepoint
 		}
 	}
 }
 
 func (self *HttpRunnerServer) otick(c *gin.Context) {
-	timepoint := getTimePoint(c)
+	timepoint := self.getTimePoint(c)
 	self.runner.oticker <- common.TimepointToTime(timepoint)
 	c.JSON(
 		http.StatusOK,
@@ -57,7 +83,7 @@ func (self *HttpRunnerServer) otick(c *gin.Context) {
 }
 
 func (self *HttpRunnerServer) atick(c *gin.Context) {
-	timepoint := getTimePoint(c)
+	timepoint := self.getTimePoint(c)
 	self.runner.aticker <- common.TimepointToTime(timepoint)
 	c.JSON(
 		http.StatusOK,
@@ -68,7 +94,7 @@ func (self *HttpRunnerServer) atick(c *gin.Context) {
 }
 
 func (self *HttpRunnerServer) rtick(c *gin.Context) {
-	timepoint := getTimePoint(c)
+	timepoint := self.getTimePoint(c)
 	self.runner.rticker <- common.TimepointToTime(timepoint)
 	c.JSON(
 		http.StatusOK,
@@ -79,7 +105,7 @@ func (self *HttpRunnerServer) rtick(c *gin.Context) {
 }
 
 func (self *HttpRunnerServer) btick(c *gin.Context) {
-	timepoint := getTimePoint(c)
+	timepoint := self.getTimePoint(c)
 	self.runner.bticker <- common.TimepointToTime(timepoint)
 	c.JSON(
 		http.StatusOK,
@@ -90,7 +116,7 @@ func (self *HttpRunnerServer) btick(c *gin.Context) {
 }
 
 func (self *HttpRunnerServer) ttick(c *gin.Context) {
-	timepoint := getTimePoint(c)
+	timepoint := self.getTimePoint(c)
 	self.runner.tticker <- common.TimepointToTime(timepoint)
 	c.JSON(
 		http.StatusOK,
@@ -101,7 +127,7 @@ func (self *HttpRunnerServer) ttick(c *gin.Context) {
 }
 
 func (self *HttpRunnerServer) gtick(c *gin.Context) {
-	timepoint := getTimePoint(c)
+	timepoint := self.getTimePoint(c)
 	self.runner.globalDataTicker <- common.TimepointToTime(timepoint)
 	c.JSON(
 		http.StatusOK,
@@ -111,47 +137,154 @@ func (self *HttpRunnerServer) gtick(c *gin.Context) {
 	)
 }
 
-func (self *HttpRunnerServer) init() {
-	self.r.GET("/otick", self.otick)
-	self.r.GET("/atick", self.atick)
-	self.r.GET("/rtick", self.rtick)
-	self.r.GET("/btick", self.btick)
-	self.r.GET("/ttick", self.ttick)
-	self.r.GET("/gtick", self.gtick)
+// secretFile is the shape of the shared-secret file at settingPaths.secretPath,
+// the same file huobi.NewSignerFromFile reads its exchange API secret from.
+type secretFile struct {
+	Secret string `json:"secret"`
 }
 
-func (self *HttpRunnerServer) Start() error {
-	if self.http == nil {
-		self.http = &http.Server{
-			Addr:    self.host,
-			Handler: self.r,
+// loadHMACSecret reads the HMAC signing secret from settingPaths.secretPath.
+func loadHMACSecret(secretPath string) (string, error) {
+	data, err := ioutil.ReadFile(secretPath)
+	if err != nil {
+		return "", err
+	}
+	var s secretFile
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	if s.Secret == "" {
+		return "", errors.New("secret file is missing a \"secret\" field")
+	}
+	return s.Secret, nil
+}
+
+// sign computes HMAC_SHA256(secret, method+path+timestamp+query), the same
+// signature callers must send as X-Signature.
+func sign(secret, method, path, timestamp, query string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + path + timestamp + query))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedRequestMiddleware rejects any request that does not carry a valid
+// X-Timestamp/X-Signature pair, modeled on the exchange request signers
+// (e.g. huobi.Signer): clients sign method+path+timestamp+query with the
+// shared secret loaded from settingPaths.secretPath.
+func signedRequestMiddleware(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timestamp := c.GetHeader("X-Timestamp")
+		signature := c.GetHeader("X-Signature")
+		if timestamp == "" || signature == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing X-Timestamp/X-Signature"})
+			return
 		}
-		return self.http.ListenAndServe()
-	} else {
-		return errors.New("server start already")
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid X-Timestamp"})
+			return
+		}
+		age := time.Since(time.Unix(0, ts*int64(time.Millisecond)))
+		if age < -MAX_SIGNATURE_AGE || age > MAX_SIGNATURE_AGE {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "stale timestamp"})
+			return
+		}
+		expected := sign(secret, c.Request.Method, c.Request.URL.Path, timestamp, c.Request.URL.RawQuery)
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+			return
+		}
+		c.Next()
 	}
 }
 
-func (self *HttpRunnerServer) Stop() error {
+func (self *HttpRunnerServer) init() {
+	group := self.r.Group("/")
+	if self.secret != "" {
+		group.Use(signedRequestMiddleware(self.secret))
+	}
+	group.GET("/otick", self.otick)
+	group.GET("/atick", self.atick)
+	group.GET("/rtick", self.rtick)
+	group.GET("/btick", self.btick)
+	group.GET("/ttick", self.ttick)
+	group.GET("/gtick", self.gtick)
+}
+
+// buildTLSConfig turns TLSConfig into a *tls.Config, wiring up mTLS (client
+// certificate verification against ClientCAFile) when that field is set.
+func buildTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	if cfg.ClientCAFile == "" {
+		return &tls.Config{}, nil
+	}
+	caCert, err := ioutil.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("could not parse client CA file %s", cfg.ClientCAFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func (self *HttpRunnerServer) Start() error {
 	if self.http != nil {
-		err := self.http.Shutdown(nil)
-		self.http = nil
+		return errors.New("server start already")
+	}
+	self.http = &http.Server{
+		Addr:    self.host,
+		Handler: self.r,
+	}
+	if self.tlsConfig == nil {
+		return self.http.ListenAndServe()
+	}
+	tlsCfg, err := buildTLSConfig(self.tlsConfig)
+	if err != nil {
 		return err
-	} else {
+	}
+	self.http.TLSConfig = tlsCfg
+	return self.http.ListenAndServeTLS(self.tlsConfig.CertFile, self.tlsConfig.KeyFile)
+}
+
+// Stop shuts the server down, giving in-flight requests until ctx's
+// deadline to finish.
+func (self *HttpRunnerServer) Stop(ctx context.Context) error {
+	if self.http == nil {
 		return errors.New("server stop already")
 	}
+	err := self.http.Shutdown(ctx)
+	self.http = nil
+	return err
 }
 
-// NewHttpRunnerServer creates a new instance of HttpRunnerServer.
-func NewHttpRunnerServer(runner *HttpRunner, host string) *HttpRunnerServer {
+// NewHttpRunnerServer creates a new instance of HttpRunnerServer. tlsConfig
+// may be nil to serve plain HTTP; secretPath, when non-empty, turns on
+// HMAC-signed request verification loaded from that settingPaths.secretPath
+// file. log is used for every diagnostic the server emits.
+func NewHttpRunnerServer(runner *HttpRunner, host string, tlsConfig *TLSConfig, secretPath string, log *logger.Logger) (*HttpRunnerServer, error) {
+	var secret string
+	if secretPath != "" {
+		var err error
+		secret, err = loadHMACSecret(secretPath)
+		if err != nil {
+			return nil, err
+		}
+	}
 	r := gin.Default()
 	r.Use(sentry.Recovery(raven.DefaultClient, false))
 	server := HttpRunnerServer{
 		runner,
 		host,
+		tlsConfig,
+		secret,
+		log,
 		r,
 		nil,
 	}
 	server.init()
-	return &server
+	return &server, nil
 }
@@ -0,0 +1,64 @@
+package http_runner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newSignedRequest(secret, timestamp string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/otick?timestamp=123", nil)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", sign(secret, req.Method, req.URL.Path, timestamp, req.URL.RawQuery))
+	return req
+}
+
+func serveWithMiddleware(secret string, req *http.Request) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(signedRequestMiddleware(secret))
+	r.GET("/otick", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"success": true}) })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSignedRequestMiddlewareAcceptsValidSignature(t *testing.T) {
+	secret := "shh"
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	w := serveWithMiddleware(secret, newSignedRequest(secret, now))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestSignedRequestMiddlewareRejectsWrongSecret(t *testing.T) {
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	req := newSignedRequest("shh", now)
+	w := serveWithMiddleware("a-different-secret", req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSignedRequestMiddlewareRejectsStaleTimestamp(t *testing.T) {
+	secret := "shh"
+	stale := strconv.FormatInt(time.Now().Add(-2*MAX_SIGNATURE_AGE).UnixNano()/int64(time.Millisecond), 10)
+	w := serveWithMiddleware(secret, newSignedRequest(secret, stale))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSignedRequestMiddlewareRejectsMissingHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	req := httptest.NewRequest(http.MethodGet, "/otick", nil)
+	w := serveWithMiddleware("shh", req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
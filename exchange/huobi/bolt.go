@@ -2,14 +2,14 @@ package huobi
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
 	"sync"
 
 	"github.com/KyberNetwork/reserve-data/common"
+	"github.com/KyberNetwork/reserve-data/common/logger"
 	"github.com/boltdb/bolt"
 )
 
@@ -17,15 +17,25 @@ const (
 	INTERMEDIATE_TX         string = "intermediate_tx"
 	PENDING_INTERMEDIATE_TX string = "pending_intermediate_tx"
 	TRADE_HISTORY           string = "trade_history"
-	MAX_GET_TRADE_HISTORY   uint64 = 3 * 86400000
 )
 
+// BoltStorage is the BoltDB-backed implementation of
+// common.TradeHistoryStorage. It keeps everything in a single file on disk,
+// which is simple to operate but means only one process can hold the file
+// lock at a time; use storage/postgres.TradeHistoryStorage when several
+// reserve-data instances need to share one store.
 type BoltStorage struct {
-	mu sync.RWMutex
-	db *bolt.DB
+	mu  sync.RWMutex
+	db  *bolt.DB
+	log *logger.Logger
 }
 
-func NewBoltStorage(path string) (*BoltStorage, error) {
+var _ common.TradeHistoryStorage = (*BoltStorage)(nil)
+
+// NewBoltStorage opens path as a BoltStorage. log is used for every
+// diagnostic the store emits; callers should pass one already tagged with
+// logger.WithExchange so entries can be filtered per exchange.
+func NewBoltStorage(path string, log *logger.Logger) (*BoltStorage, error) {
 	// init instance
 	var err error
 	var db *bolt.DB
@@ -43,7 +53,7 @@ func NewBoltStorage(path string) (*BoltStorage, error) {
 		}
 		return nil
 	})
-	storage := &BoltStorage{sync.RWMutex{}, db}
+	storage := &BoltStorage{sync.RWMutex{}, db, log}
 	return storage, nil
 }
 
@@ -161,6 +171,15 @@ func (self *BoltStorage) GetIntermedatorTx(id common.ActivityID) (common.TXEntry
 	return tx2, err
 }
 
+// dayBucket buckets are keyed by day number (ts / DAY_MS) so that a range
+// read only has to open the day buckets that intersect [from, to] instead
+// of scanning every trade a pair has ever recorded.
+const DAY_MS uint64 = 86400000
+
+func dayBucket(ts uint64) uint64 {
+	return ts / DAY_MS
+}
+
 func (self *BoltStorage) StoreTradeHistory(data common.AllTradeHistory) error {
 	var err error
 	err = self.db.Update(func(tx *bolt.Tx) error {
@@ -168,20 +187,26 @@ func (self *BoltStorage) StoreTradeHistory(data common.AllTradeHistory) error {
 		for exchange, dataHistory := range data.Data {
 			exchangeBk, err := b.CreateBucketIfNotExists([]byte(exchange))
 			if err != nil {
-				log.Printf("Cannot create exchange history bucket: %s", err.Error())
+				self.log.Errorf("Cannot create exchange history bucket: %s", err.Error())
 			}
 			for pair, pairHistory := range dataHistory {
 				pairBk, err := exchangeBk.CreateBucketIfNotExists([]byte(pair))
 				if err != nil {
-					log.Printf("Cannot create pair history bucket: %s", err.Error())
+					self.log.Errorf("Cannot create pair history bucket: %s", err.Error())
 				}
 				for _, history := range pairHistory {
+					dayBk, err := pairBk.CreateBucketIfNotExists(uint64ToBytes(dayBucket(history.Timestamp)))
+					if err != nil {
+						self.log.Errorf("Cannot create day bucket: %s", err.Error())
+						continue
+					}
 					idBytes := uint64ToBytes(history.Timestamp)
 					dataJSON, err := json.Marshal(history)
 					if err != nil {
-						log.Printf("Cannot marshal history: %s", err.Error())
+						self.log.Errorf("Cannot marshal history: %s", err.Error())
+						continue
 					}
-					pairBk.Put(idBytes, dataJSON)
+					dayBk.Put(idBytes, dataJSON)
 				}
 			}
 		}
@@ -190,17 +215,16 @@ func (self *BoltStorage) StoreTradeHistory(data common.AllTradeHistory) error {
 	return err
 }
 
+// GetTradeHistory returns every trade in [fromTime, toTime]. It is kept for
+// callers that want the whole range at once; GetTradeHistoryPage is bounded
+// by limit rather than range width and should be preferred for wide ranges
+// since this loads the full result into memory.
 func (self *BoltStorage) GetTradeHistory(fromTime, toTime uint64) (common.AllTradeHistory, error) {
 	result := common.AllTradeHistory{
 		Timestamp: common.GetTimestamp(),
 		Data:      map[common.ExchangeID]common.ExchangeTradeHistory{},
 	}
 	var err error
-	if toTime-fromTime > MAX_GET_TRADE_HISTORY {
-		return result, errors.New(fmt.Sprintf("Time range is too broad, it must be smaller or equal to 3 days (miliseconds)"))
-	}
-	min := uint64ToBytes(fromTime)
-	max := uint64ToBytes(toTime)
 	err = self.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(TRADE_HISTORY))
 		c := b.Cursor()
@@ -210,14 +234,7 @@ func (self *BoltStorage) GetTradeHistory(fromTime, toTime uint64) (common.AllTra
 			exchangeHistory := common.ExchangeTradeHistory{}
 			for key, value := cursor.First(); key != nil && value == nil; key, value = cursor.Next() {
 				pairBk := exchangeBk.Bucket(key)
-				pairsHistory := []common.TradeHistory{}
-				pairCursor := pairBk.Cursor()
-				for pairKey, history := pairCursor.Seek(min); pairKey != nil && bytes.Compare(pairKey, max) <= 0; pairKey, history = pairCursor.Next() {
-					pairHistory := common.TradeHistory{}
-					json.Unmarshal(history, &pairHistory)
-					pairsHistory = append(pairsHistory, pairHistory)
-				}
-				exchangeHistory[common.TokenPairID(key)] = pairsHistory
+				exchangeHistory[common.TokenPairID(key)] = self.readPairRange(pairBk, fromTime, toTime)
 			}
 			result.Data[common.ExchangeID(k)] = exchangeHistory
 		}
@@ -226,25 +243,268 @@ func (self *BoltStorage) GetTradeHistory(fromTime, toTime uint64) (common.AllTra
 	return result, err
 }
 
+// readPairRange walks only the day buckets of pairBk that intersect
+// [fromTime, toTime]; it must be called from within an open bolt transaction.
+func (self *BoltStorage) readPairRange(pairBk *bolt.Bucket, fromTime, toTime uint64) []common.TradeHistory {
+	pairsHistory := []common.TradeHistory{}
+	minDay := uint64ToBytes(dayBucket(fromTime))
+	maxDay := uint64ToBytes(dayBucket(toTime))
+	min := uint64ToBytes(fromTime)
+	max := uint64ToBytes(toTime)
+	dayCursor := pairBk.Cursor()
+	for dayKey, _ := dayCursor.Seek(minDay); dayKey != nil && bytes.Compare(dayKey, maxDay) <= 0; dayKey, _ = dayCursor.Next() {
+		dayBk := pairBk.Bucket(dayKey)
+		entryCursor := dayBk.Cursor()
+		for tsKey, data := entryCursor.Seek(min); tsKey != nil && bytes.Compare(tsKey, max) <= 0; tsKey, data = entryCursor.Next() {
+			history := common.TradeHistory{}
+			json.Unmarshal(data, &history)
+			pairsHistory = append(pairsHistory, history)
+		}
+	}
+	return pairsHistory
+}
+
 func (self *BoltStorage) GetLastIDTradeHistory(exchange, pair string) (string, error) {
 	history := common.TradeHistory{}
 	err := self.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(TRADE_HISTORY))
 		exchangeBk, err := b.CreateBucketIfNotExists([]byte(exchange))
 		if err != nil {
-			log.Printf("Cannot get exchange bucket: %s", err.Error())
+			self.log.Errorf("Cannot get exchange bucket: %s", err.Error())
 			return err
 		}
 		pairBk, err := exchangeBk.CreateBucketIfNotExists([]byte(pair))
 		if err != nil {
-			log.Printf("Cannot get pair bucket: %s", err.Error())
+			self.log.Errorf("Cannot get pair bucket: %s", err.Error())
 			return err
 		}
-		k, v := pairBk.Cursor().Last()
+		dayKey, _ := pairBk.Cursor().Last()
+		if dayKey == nil {
+			return nil
+		}
+		dayBk := pairBk.Bucket(dayKey)
+		k, v := dayBk.Cursor().Last()
 		if k != nil {
 			json.Unmarshal(v, &history)
 		}
-		return err
+		return nil
 	})
 	return history.ID, err
 }
+
+// tradeHistoryCursor is the opaque pagination cursor used by
+// GetTradeHistoryPage: it records the last (exchange, pair, timestamp)
+// returned so the next page can resume from there, including across
+// process restarts.
+type tradeHistoryCursor struct {
+	Exchange string `json:"exchange"`
+	Pair     string `json:"pair"`
+	LastTs   uint64 `json:"last_ts"`
+}
+
+func decodeTradeHistoryCursor(data []byte) (*tradeHistoryCursor, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	cursor := &tradeHistoryCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+func (c *tradeHistoryCursor) encode() []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+// isAfterCursor reports whether (exchange, pair) sorts after cursor's own
+// (exchange, pair) under the same ordering pairStreamHeap.Less uses to break
+// timestamp ties. It's used to tell, among entries sharing cursor.LastTs,
+// which ones the previous page already delivered.
+func isAfterCursor(exchange, pair string, cursor *tradeHistoryCursor) bool {
+	if exchange != cursor.Exchange {
+		return exchange > cursor.Exchange
+	}
+	return pair > cursor.Pair
+}
+
+// pairStream walks one (exchange, pair)'s trades in increasing timestamp
+// order, across day buckets, stopping at toTime. It is one leg of the
+// k-way merge done by GetTradeHistoryPage.
+type pairStream struct {
+	exchange, pair string
+	pairBk         *bolt.Bucket
+	dayCursor      *bolt.Cursor
+	entryCursor    *bolt.Cursor
+	toDay          uint64
+	toTime         uint64
+	ts             uint64
+	data           []byte
+}
+
+func newPairStream(exchange, pair string, pairBk *bolt.Bucket, fromTime, toTime uint64) *pairStream {
+	s := &pairStream{
+		exchange: exchange,
+		pair:     pair,
+		pairBk:   pairBk,
+		toDay:    dayBucket(toTime),
+		toTime:   toTime,
+	}
+	s.dayCursor = pairBk.Cursor()
+	dayKey, _ := s.dayCursor.Seek(uint64ToBytes(dayBucket(fromTime)))
+	if !s.seekWithinDay(dayKey, fromTime) {
+		return nil
+	}
+	return s
+}
+
+// seekWithinDay positions the stream at the first entry >= minTs starting
+// at dayKey, advancing through later day buckets (up to toDay) if dayKey's
+// bucket has nothing at or after minTs. Returns false once there is
+// nothing left in range.
+func (s *pairStream) seekWithinDay(dayKey []byte, minTs uint64) bool {
+	for dayKey != nil {
+		if bytesToUint64(dayKey) > s.toDay {
+			return false
+		}
+		dayBk := s.pairBk.Bucket(dayKey)
+		entryCursor := dayBk.Cursor()
+		tsKey, data := entryCursor.Seek(uint64ToBytes(minTs))
+		if tsKey != nil {
+			ts := bytesToUint64(tsKey)
+			if ts > s.toTime {
+				return false
+			}
+			s.entryCursor = entryCursor
+			s.ts = ts
+			s.data = data
+			return true
+		}
+		dayKey, _ = s.dayCursor.Next()
+		minTs = 0
+	}
+	return false
+}
+
+// advance moves the stream to its next entry, returning false when the
+// stream is exhausted within [_, toTime].
+func (s *pairStream) advance() bool {
+	if tsKey, data := s.entryCursor.Next(); tsKey != nil {
+		ts := bytesToUint64(tsKey)
+		if ts > s.toTime {
+			return false
+		}
+		s.ts = ts
+		s.data = data
+		return true
+	}
+	dayKey, _ := s.dayCursor.Next()
+	return s.seekWithinDay(dayKey, 0)
+}
+
+// pairStreamHeap is a min-heap of pairStreams ordered by timestamp, used to
+// merge many (exchange, pair) streams into one chronological page.
+type pairStreamHeap []*pairStream
+
+func (h pairStreamHeap) Len() int { return len(h) }
+func (h pairStreamHeap) Less(i, j int) bool {
+	if h[i].ts != h[j].ts {
+		return h[i].ts < h[j].ts
+	}
+	if h[i].exchange != h[j].exchange {
+		return h[i].exchange < h[j].exchange
+	}
+	return h[i].pair < h[j].pair
+}
+func (h pairStreamHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pairStreamHeap) Push(x interface{}) { *h = append(*h, x.(*pairStream)) }
+func (h *pairStreamHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// GetTradeHistoryPage returns up to limit trades in [fromTime, toTime], in
+// increasing timestamp order across every exchange/pair, via a bounded
+// k-way merge over their day buckets. Memory use is O(limit) regardless of
+// how wide the range is: only one entry per pair is held in the heap at a
+// time. Pass the returned nextCursor back in to resume; nextCursor is nil
+// once the range is exhausted.
+func (self *BoltStorage) GetTradeHistoryPage(fromTime, toTime uint64, cursor []byte, limit int) (common.AllTradeHistory, []byte, error) {
+	result := common.AllTradeHistory{
+		Timestamp: common.GetTimestamp(),
+		Data:      map[common.ExchangeID]common.ExchangeTradeHistory{},
+	}
+	if limit <= 0 {
+		return result, nil, errors.New("limit must be greater than 0")
+	}
+	resumeFrom, err := decodeTradeHistoryCursor(cursor)
+	if err != nil {
+		return result, nil, err
+	}
+	var nextCursor []byte
+	err = self.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(TRADE_HISTORY))
+		streams := &pairStreamHeap{}
+		heap.Init(streams)
+		exchangeCursor := b.Cursor()
+		for ek, ev := exchangeCursor.First(); ek != nil && ev == nil; ek, ev = exchangeCursor.Next() {
+			exchange := string(ek)
+			exchangeBk := b.Bucket(ek)
+			pairCursor := exchangeBk.Cursor()
+			for pk, pv := pairCursor.First(); pk != nil && pv == nil; pk, pv = pairCursor.Next() {
+				pair := string(pk)
+				from := fromTime
+				if resumeFrom != nil && resumeFrom.LastTs > from {
+					// Every pair, not just the cursor's own, may have
+					// already delivered entries up to LastTs: the page
+					// before this one interleaved them chronologically
+					// across all pairs, not one pair at a time.
+					from = resumeFrom.LastTs
+				}
+				stream := newPairStream(exchange, pair, exchangeBk.Bucket(pk), from, toTime)
+				// Entries exactly at LastTs were split between "already
+				// delivered" and "not yet delivered" by the same
+				// (exchange, pair) tiebreak pairStreamHeap.Less uses, so
+				// skip forward past the ones the previous page already
+				// returned.
+				for resumeFrom != nil && stream != nil && stream.ts == resumeFrom.LastTs &&
+					!isAfterCursor(exchange, pair, resumeFrom) {
+					if !stream.advance() {
+						stream = nil
+					}
+				}
+				if stream != nil {
+					heap.Push(streams, stream)
+				}
+			}
+		}
+		count := 0
+		for streams.Len() > 0 && count < limit {
+			stream := heap.Pop(streams).(*pairStream)
+			history := common.TradeHistory{}
+			json.Unmarshal(stream.data, &history)
+			exchangeID := common.ExchangeID(stream.exchange)
+			exchangeHistory, ok := result.Data[exchangeID]
+			if !ok {
+				exchangeHistory = common.ExchangeTradeHistory{}
+				result.Data[exchangeID] = exchangeHistory
+			}
+			pairID := common.TokenPairID(stream.pair)
+			exchangeHistory[pairID] = append(exchangeHistory[pairID], history)
+			nextCursor = (&tradeHistoryCursor{stream.exchange, stream.pair, stream.ts}).encode()
+			count++
+			if stream.advance() {
+				heap.Push(streams, stream)
+			}
+		}
+		if streams.Len() == 0 {
+			nextCursor = nil
+		}
+		return nil
+	})
+	return result, nextCursor, err
+}
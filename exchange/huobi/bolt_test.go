@@ -0,0 +1,76 @@
+package huobi
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/KyberNetwork/reserve-data/common"
+	"github.com/KyberNetwork/reserve-data/common/logger"
+)
+
+func newTestBoltStorage(t *testing.T) (*BoltStorage, func()) {
+	f, err := ioutil.TempFile("", "bolt_test")
+	if err != nil {
+		t.Fatalf("cannot create temp file: %s", err.Error())
+	}
+	f.Close()
+	storage, err := NewBoltStorage(f.Name(), logger.New())
+	if err != nil {
+		t.Fatalf("cannot open storage: %s", err.Error())
+	}
+	return storage, func() { os.Remove(f.Name()) }
+}
+
+func tradeAt(ts uint64) common.TradeHistory {
+	return common.TradeHistory{Timestamp: ts}
+}
+
+// TestGetTradeHistoryPageNoDuplicatesAcrossPages reproduces the scenario
+// from review: two pairs interleaved by timestamp must not repeat an entry
+// that a previous page already delivered from a pair other than the one the
+// cursor points at.
+func TestGetTradeHistoryPageNoDuplicatesAcrossPages(t *testing.T) {
+	storage, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	data := common.AllTradeHistory{
+		Data: map[common.ExchangeID]common.ExchangeTradeHistory{
+			"huobi": {
+				"btc_eth":  {tradeAt(100), tradeAt(200), tradeAt(300)},
+				"eth_usdt": {tradeAt(150), tradeAt(250), tradeAt(350)},
+			},
+		},
+	}
+	if err := storage.StoreTradeHistory(data); err != nil {
+		t.Fatalf("cannot store trade history: %s", err.Error())
+	}
+
+	seen := map[uint64]int{}
+	var cursor []byte
+	for {
+		page, next, err := storage.GetTradeHistoryPage(100, 350, cursor, 3)
+		if err != nil {
+			t.Fatalf("GetTradeHistoryPage failed: %s", err.Error())
+		}
+		for _, pairHistory := range page.Data["huobi"] {
+			for _, h := range pairHistory {
+				seen[h.Timestamp]++
+			}
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+
+	wantTs := []uint64{100, 150, 200, 250, 300, 350}
+	for _, ts := range wantTs {
+		if seen[ts] != 1 {
+			t.Errorf("trade at ts %d delivered %d times, want exactly 1", ts, seen[ts])
+		}
+	}
+	if len(seen) != len(wantTs) {
+		t.Errorf("delivered %d distinct timestamps, want %d", len(seen), len(wantTs))
+	}
+}
@@ -0,0 +1,297 @@
+// Package remote implements the fetcher.Exchange contract over RPC instead
+// of in-process, so a stuck per-exchange REST call or a locked BoltDB file
+// can no longer block the whole fetch cycle, and each exchange can be
+// scaled out to its own process. The server side lives in
+// cmd/exchange-worker; it hosts exactly one exchange and exposes its
+// FetchOnePairData/FetchTradeHistory/DepositStatus/WithdrawStatus/
+// OrderStatus/Trade/Withdraw/CancelOrder methods as RPC calls.
+package remote
+
+import (
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/KyberNetwork/reserve-data/common"
+	"github.com/KyberNetwork/reserve-data/common/logger"
+)
+
+// serviceName is the net/rpc service cmd/exchange-worker registers its
+// Worker type under; every call is dispatched as serviceName + ".Method".
+const serviceName = "Worker"
+
+// backoff bounds the reconnect delay: it starts at initialBackoff and
+// doubles up to maxBackoff on each consecutive failed dial.
+const (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+	maxDialRetries = 5
+)
+
+// Exchange is a fetcher.Exchange backed by a cmd/exchange-worker process
+// reachable at addr. Construct one with Dial.
+type Exchange struct {
+	id   common.ExchangeID
+	addr string
+	log  *logger.Logger
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+// Dial connects to the exchange worker listening at addr ("host:port").
+// id is only reported back by Exchange.ID(); it is not sent to or checked
+// against the worker, which itself decides which exchange it hosts.
+func Dial(id common.ExchangeID, addr string, log *logger.Logger) (*Exchange, error) {
+	client, err := rpc.DialHTTP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Exchange{id: id, addr: addr, log: log, client: client}, nil
+}
+
+// ID implements fetcher.Exchange.
+func (self *Exchange) ID() common.ExchangeID { return self.id }
+
+// call invokes method on the worker, reconnecting with backoff once if the
+// connection appears to have dropped (rpc.ErrShutdown), then retrying.
+func (self *Exchange) call(method string, args, reply interface{}) error {
+	err := self.currentClient().Call(serviceName+"."+method, args, reply)
+	if err != rpc.ErrShutdown {
+		return err
+	}
+	self.log.Warnf("lost connection to exchange worker at %s, reconnecting", self.addr)
+	if err := self.reconnect(); err != nil {
+		return err
+	}
+	return self.currentClient().Call(serviceName+"."+method, args, reply)
+}
+
+// currentClient returns the *rpc.Client in use right now, guarding against
+// reconnect() swapping it out concurrently.
+func (self *Exchange) currentClient() *rpc.Client {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.client
+}
+
+// reconnect redials self.addr with exponential backoff, capped at
+// maxDialRetries attempts.
+func (self *Exchange) reconnect() error {
+	var err error
+	backoff := initialBackoff
+	for attempt := 0; attempt < maxDialRetries; attempt++ {
+		var client *rpc.Client
+		if client, err = rpc.DialHTTP("tcp", self.addr); err == nil {
+			self.mu.Lock()
+			self.client = client
+			self.mu.Unlock()
+			return nil
+		}
+		self.log.Warnf("reconnect attempt %d to %s failed: %s", attempt+1, self.addr, err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return err
+}
+
+// FetchOnePairDataArgs/Reply etc. are the RPC-safe (de)serializable
+// payloads for each fetcher.Exchange method. They carry the same
+// information as the in-process signatures, flattened to types that travel
+// over net/rpc (which uses encoding/gob) cleanly.
+
+type FetchOnePairDataArgs struct {
+	Timepoint uint64
+	Pair      common.TokenPairID
+}
+
+type FetchOnePairDataReply struct {
+	Data []byte // JSON-encoded common.ExchangePrice
+	Err  string
+}
+
+func (self *Exchange) FetchOnePairData(timepoint uint64, pair common.TokenPairID) ([]byte, error) {
+	reply := FetchOnePairDataReply{}
+	if err := self.call("FetchOnePairData", &FetchOnePairDataArgs{timepoint, pair}, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Err != "" {
+		return reply.Data, errorString(reply.Err)
+	}
+	return reply.Data, nil
+}
+
+type FetchTradeHistoryArgs struct {
+	Timepoint uint64
+}
+
+type FetchTradeHistoryReply struct {
+	Data common.AllTradeHistory
+	Err  string
+}
+
+func (self *Exchange) FetchTradeHistory(timepoint uint64) (common.AllTradeHistory, error) {
+	reply := FetchTradeHistoryReply{}
+	if err := self.call("FetchTradeHistory", &FetchTradeHistoryArgs{timepoint}, &reply); err != nil {
+		return reply.Data, err
+	}
+	if reply.Err != "" {
+		return reply.Data, errorString(reply.Err)
+	}
+	return reply.Data, nil
+}
+
+type DepositStatusArgs struct {
+	ID        common.ActivityID
+	TxHash    string
+	Currency  string
+	Amount    float64
+	Timepoint uint64
+}
+
+type DepositStatusReply struct {
+	Status string
+	Err    string
+}
+
+func (self *Exchange) DepositStatus(id common.ActivityID, txHash, currency string, amount float64, timepoint uint64) (string, error) {
+	reply := DepositStatusReply{}
+	args := &DepositStatusArgs{id, txHash, currency, amount, timepoint}
+	if err := self.call("DepositStatus", args, &reply); err != nil {
+		return "", err
+	}
+	if reply.Err != "" {
+		return reply.Status, errorString(reply.Err)
+	}
+	return reply.Status, nil
+}
+
+type WithdrawStatusArgs struct {
+	ID        string
+	Currency  string
+	Amount    float64
+	Timepoint uint64
+}
+
+type WithdrawStatusReply struct {
+	Status string
+	TxHash string
+	Err    string
+}
+
+func (self *Exchange) WithdrawStatus(id, currency string, amount float64, timepoint uint64) (string, string, error) {
+	reply := WithdrawStatusReply{}
+	args := &WithdrawStatusArgs{id, currency, amount, timepoint}
+	if err := self.call("WithdrawStatus", args, &reply); err != nil {
+		return "", "", err
+	}
+	if reply.Err != "" {
+		return reply.Status, reply.TxHash, errorString(reply.Err)
+	}
+	return reply.Status, reply.TxHash, nil
+}
+
+type OrderStatusArgs struct {
+	ID        common.ActivityID
+	Base      string
+	Quote     string
+	Timepoint uint64
+}
+
+type OrderStatusReply struct {
+	Status string
+	Err    string
+}
+
+func (self *Exchange) OrderStatus(id common.ActivityID, base, quote string, timepoint uint64) (string, error) {
+	reply := OrderStatusReply{}
+	args := &OrderStatusArgs{id, base, quote, timepoint}
+	if err := self.call("OrderStatus", args, &reply); err != nil {
+		return "", err
+	}
+	if reply.Err != "" {
+		return reply.Status, errorString(reply.Err)
+	}
+	return reply.Status, nil
+}
+
+type TradeArgs struct {
+	TradeType string
+	Base      string
+	Quote     string
+	Rate      float64
+	Amount    float64
+	Timepoint uint64
+}
+
+type TradeReply struct {
+	ID        common.ActivityID
+	Done      float64
+	Remaining float64
+	Finished  bool
+	Err       string
+}
+
+func (self *Exchange) Trade(tradeType string, base, quote string, rate, amount float64, timepoint uint64) (common.ActivityID, float64, float64, bool, error) {
+	reply := TradeReply{}
+	args := &TradeArgs{tradeType, base, quote, rate, amount, timepoint}
+	if err := self.call("Trade", args, &reply); err != nil {
+		return reply.ID, reply.Done, reply.Remaining, reply.Finished, err
+	}
+	if reply.Err != "" {
+		return reply.ID, reply.Done, reply.Remaining, reply.Finished, errorString(reply.Err)
+	}
+	return reply.ID, reply.Done, reply.Remaining, reply.Finished, nil
+}
+
+type WithdrawArgs struct {
+	Token     string
+	Amount    string // decimal string, to avoid precision loss over RPC
+	Address   string
+	Timepoint uint64
+}
+
+type WithdrawReply struct {
+	TxHash string
+	Err    string
+}
+
+func (self *Exchange) Withdraw(token, amount, address string, timepoint uint64) (string, error) {
+	reply := WithdrawReply{}
+	args := &WithdrawArgs{token, amount, address, timepoint}
+	if err := self.call("Withdraw", args, &reply); err != nil {
+		return "", err
+	}
+	if reply.Err != "" {
+		return reply.TxHash, errorString(reply.Err)
+	}
+	return reply.TxHash, nil
+}
+
+type CancelOrderArgs struct {
+	ID common.ActivityID
+}
+
+type CancelOrderReply struct {
+	Err string
+}
+
+func (self *Exchange) CancelOrder(id common.ActivityID) error {
+	reply := CancelOrderReply{}
+	if err := self.call("CancelOrder", &CancelOrderArgs{id}, &reply); err != nil {
+		return err
+	}
+	if reply.Err != "" {
+		return errorString(reply.Err)
+	}
+	return nil
+}
+
+// errorString lets an error message survive the gob round trip: the error
+// interface itself isn't gob-registrable, so RPC replies carry Err as a
+// plain string and the client re-wraps it here.
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
@@ -0,0 +1,327 @@
+// Package postgres provides a common.TradeHistoryStorage implementation
+// backed by PostgreSQL, so several reserve-data instances can share a single
+// trade-history store instead of each keeping its own BoltDB file.
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/KyberNetwork/reserve-data/common"
+	"github.com/KyberNetwork/reserve-data/common/logger"
+	// the pq driver registers itself under the "postgres" name
+	_ "github.com/lib/pq"
+)
+
+// TradeHistoryStorage is the PostgreSQL-backed implementation of
+// common.TradeHistoryStorage.
+type TradeHistoryStorage struct {
+	db  *sql.DB
+	log *logger.Logger
+}
+
+// NewTradeHistoryStorage opens (and migrates) a PostgreSQL-backed trade
+// history store. dbURL is a standard "postgres://..." connection string.
+// log is used for every diagnostic the store emits; callers should pass one
+// already tagged with logger.WithExchange so entries can be filtered per
+// exchange.
+func NewTradeHistoryStorage(dbURL string, log *logger.Logger) (*TradeHistoryStorage, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	storage := &TradeHistoryStorage{db: db, log: log}
+	if err := storage.ensureSchema(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (self *TradeHistoryStorage) ensureSchema() error {
+	_, err := self.db.Exec(`
+		CREATE TABLE IF NOT EXISTS trade_history (
+			exchange  TEXT NOT NULL,
+			pair      TEXT NOT NULL,
+			timestamp BIGINT NOT NULL,
+			data      JSONB NOT NULL,
+			PRIMARY KEY (exchange, pair, timestamp)
+		);
+		CREATE TABLE IF NOT EXISTS intermediate_tx (
+			activity_id TEXT PRIMARY KEY,
+			data        JSONB NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS pending_intermediate_tx (
+			activity_id TEXT PRIMARY KEY,
+			data        JSONB NOT NULL
+		);
+	`)
+	return err
+}
+
+var _ common.TradeHistoryStorage = (*TradeHistoryStorage)(nil)
+
+func (self *TradeHistoryStorage) StoreTradeHistory(data common.AllTradeHistory) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	for exchange, dataHistory := range data.Data {
+		for pair, pairHistory := range dataHistory {
+			for _, history := range pairHistory {
+				dataJSON, err := json.Marshal(history)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+				if _, err := tx.Exec(
+					`INSERT INTO trade_history (exchange, pair, timestamp, data)
+					 VALUES ($1, $2, $3, $4)
+					 ON CONFLICT (exchange, pair, timestamp) DO UPDATE SET data = EXCLUDED.data`,
+					string(exchange), string(pair), history.Timestamp, dataJSON,
+				); err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetTradeHistory returns every trade in [fromTime, toTime], with no upper
+// bound on the range width. Like huobi.BoltStorage.GetTradeHistory, it loads
+// the whole result into memory; GetTradeHistoryPage is the bounded variant.
+func (self *TradeHistoryStorage) GetTradeHistory(fromTime, toTime uint64) (common.AllTradeHistory, error) {
+	result := common.AllTradeHistory{
+		Timestamp: common.GetTimestamp(),
+		Data:      map[common.ExchangeID]common.ExchangeTradeHistory{},
+	}
+	rows, err := self.db.Query(
+		`SELECT exchange, pair, data FROM trade_history
+		 WHERE timestamp >= $1 AND timestamp <= $2
+		 ORDER BY exchange, pair, timestamp`,
+		fromTime, toTime,
+	)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var exchange, pair string
+		var dataJSON []byte
+		if err := rows.Scan(&exchange, &pair, &dataJSON); err != nil {
+			return result, err
+		}
+		history := common.TradeHistory{}
+		if err := json.Unmarshal(dataJSON, &history); err != nil {
+			return result, err
+		}
+		exchangeID := common.ExchangeID(exchange)
+		exchangeHistory, ok := result.Data[exchangeID]
+		if !ok {
+			exchangeHistory = common.ExchangeTradeHistory{}
+			result.Data[exchangeID] = exchangeHistory
+		}
+		pairID := common.TokenPairID(pair)
+		exchangeHistory[pairID] = append(exchangeHistory[pairID], history)
+	}
+	return result, rows.Err()
+}
+
+// tradeHistoryCursor mirrors exchange/huobi.BoltStorage's pagination cursor:
+// the last (exchange, pair, timestamp) delivered, so the next page can
+// resume from there, including across process restarts.
+type tradeHistoryCursor struct {
+	Exchange string `json:"exchange"`
+	Pair     string `json:"pair"`
+	LastTs   uint64 `json:"last_ts"`
+}
+
+// GetTradeHistoryPage returns up to limit trades in [fromTime, toTime], in
+// increasing (timestamp, exchange, pair) order. Unlike huobi.BoltStorage's
+// k-way merge over BoltDB cursors, a single ORDER BY query does the merge
+// here. That order differs from the (exchange, pair, timestamp) primary key,
+// so the primary key index does not provide it.
+func (self *TradeHistoryStorage) GetTradeHistoryPage(fromTime, toTime uint64, cursor []byte, limit int) (common.AllTradeHistory, []byte, error) {
+	result := common.AllTradeHistory{
+		Timestamp: common.GetTimestamp(),
+		Data:      map[common.ExchangeID]common.ExchangeTradeHistory{},
+	}
+	if limit <= 0 {
+		return result, nil, errors.New("limit must be greater than 0")
+	}
+	from := fromTime
+	resumeFrom := &tradeHistoryCursor{}
+	if len(cursor) > 0 {
+		if err := json.Unmarshal(cursor, resumeFrom); err != nil {
+			return result, nil, err
+		}
+		from = resumeFrom.LastTs
+	} else {
+		resumeFrom = nil
+	}
+	rows, err := self.db.Query(
+		`SELECT exchange, pair, timestamp, data FROM trade_history
+		 WHERE timestamp >= $1 AND timestamp <= $2
+		   AND ($3::bigint IS NULL OR timestamp > $3 OR (exchange, pair) > ($4, $5))
+		 ORDER BY timestamp, exchange, pair
+		 LIMIT $6`,
+		from, toTime, sqlLastTs(resumeFrom), sqlExchange(resumeFrom), sqlPair(resumeFrom), limit,
+	)
+	if err != nil {
+		return result, nil, err
+	}
+	defer rows.Close()
+	var nextCursor []byte
+	for rows.Next() {
+		var exchange, pair string
+		var timestamp uint64
+		var dataJSON []byte
+		if err := rows.Scan(&exchange, &pair, &timestamp, &dataJSON); err != nil {
+			return result, nil, err
+		}
+		history := common.TradeHistory{}
+		if err := json.Unmarshal(dataJSON, &history); err != nil {
+			return result, nil, err
+		}
+		exchangeID := common.ExchangeID(exchange)
+		exchangeHistory, ok := result.Data[exchangeID]
+		if !ok {
+			exchangeHistory = common.ExchangeTradeHistory{}
+			result.Data[exchangeID] = exchangeHistory
+		}
+		pairID := common.TokenPairID(pair)
+		exchangeHistory[pairID] = append(exchangeHistory[pairID], history)
+		nextCursor, err = json.Marshal(tradeHistoryCursor{Exchange: exchange, Pair: pair, LastTs: timestamp})
+		if err != nil {
+			return result, nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, nil, err
+	}
+	return result, nextCursor, nil
+}
+
+// sqlLastTs/sqlExchange/sqlPair unpack a possibly-nil cursor into the
+// parameters GetTradeHistoryPage's query binds as $3/$4/$5. A nil cursor
+// (first page) disables the "$3::bigint IS NULL" branch's siblings via the
+// short-circuiting OR, so the whole WHERE clause degrades to a plain
+// timestamp range.
+func sqlLastTs(c *tradeHistoryCursor) interface{} {
+	if c == nil {
+		return nil
+	}
+	return c.LastTs
+}
+
+func sqlExchange(c *tradeHistoryCursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.Exchange
+}
+
+func sqlPair(c *tradeHistoryCursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.Pair
+}
+
+func (self *TradeHistoryStorage) GetLastIDTradeHistory(exchange, pair string) (string, error) {
+	history := common.TradeHistory{}
+	var dataJSON []byte
+	err := self.db.QueryRow(
+		`SELECT data FROM trade_history WHERE exchange = $1 AND pair = $2 ORDER BY timestamp DESC LIMIT 1`,
+		exchange, pair,
+	).Scan(&dataJSON)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(dataJSON, &history); err != nil {
+		return "", err
+	}
+	return history.ID, nil
+}
+
+func (self *TradeHistoryStorage) StorePendingIntermediateTx(id common.ActivityID, data common.TXEntry) error {
+	return self.putTx("pending_intermediate_tx", id, data)
+}
+
+func (self *TradeHistoryStorage) StoreIntermediateTx(id common.ActivityID, data common.TXEntry) error {
+	return self.putTx("intermediate_tx", id, data)
+}
+
+func (self *TradeHistoryStorage) putTx(table string, id common.ActivityID, data common.TXEntry) error {
+	idJSON, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = self.db.Exec(
+		`INSERT INTO `+table+` (activity_id, data) VALUES ($1, $2)
+		 ON CONFLICT (activity_id) DO UPDATE SET data = EXCLUDED.data`,
+		string(idJSON), dataJSON,
+	)
+	return err
+}
+
+func (self *TradeHistoryStorage) GetIntermedatorTx(id common.ActivityID) (common.TXEntry, error) {
+	tx2 := common.TXEntry{}
+	idJSON, err := json.Marshal(id)
+	if err != nil {
+		return tx2, err
+	}
+	var dataJSON []byte
+	err = self.db.QueryRow(
+		`SELECT data FROM intermediate_tx WHERE activity_id = $1`, string(idJSON),
+	).Scan(&dataJSON)
+	if err == sql.ErrNoRows {
+		return tx2, errors.New("Can not find 2nd transaction tx for the deposit, please try later")
+	}
+	if err != nil {
+		return tx2, err
+	}
+	err = json.Unmarshal(dataJSON, &tx2)
+	return tx2, err
+}
+
+func (self *TradeHistoryStorage) GetPendingIntermediateTXs() (map[common.ActivityID]common.TXEntry, error) {
+	result := make(map[common.ActivityID]common.TXEntry)
+	rows, err := self.db.Query(`SELECT activity_id, data FROM pending_intermediate_tx`)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var idJSON, dataJSON []byte
+		if err := rows.Scan(&idJSON, &dataJSON); err != nil {
+			return result, err
+		}
+		actID := common.ActivityID{}
+		record := common.TXEntry{}
+		if err := json.Unmarshal(idJSON, &actID); err != nil {
+			return result, err
+		}
+		if err := json.Unmarshal(dataJSON, &record); err != nil {
+			return result, err
+		}
+		result[actID] = record
+	}
+	if err := rows.Err(); err != nil {
+		self.log.Errorf("Error while scanning pending intermediate txs: %s", err.Error())
+		return result, err
+	}
+	return result, nil
+}